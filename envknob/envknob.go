@@ -10,6 +10,18 @@
 // when debugging something. They are not a stable interface and may
 // be removed or any time.
 //
+// Values may also be sourced from a config file named by the
+// TS_ENVKNOB_FILE environment variable (see file.go), for knobs
+// registered via RegisterString, RegisterBool, RegisterInt,
+// RegisterDuration, or Register. Precedence is environment variable,
+// then config file, then the knob's default. Use Watch to pick up
+// config file edits without a process restart.
+//
+// Register additionally takes a Spec describing a knob's owner,
+// description, and validator; Knobs returns the resulting registry,
+// and the http.Handler returned by Handler serves it over HTTP (see
+// Handler's doc for why).
+//
 // A related package, control/controlknobs, are knobs that can be
 // changed at runtime by the control plane. Sometimes both are used:
 // an envknob for the default/explicit value, else falling back
@@ -30,10 +42,8 @@ import (
 )
 
 var (
-	mu      sync.Mutex
-	set     = map[string]string{}
-	regStr  = map[string]*string{}
-	regBool = map[string]*bool{}
+	mu  sync.Mutex
+	set = map[string]string{}
 )
 
 func noteEnv(k, v string) {
@@ -70,61 +80,20 @@ func LogCurrent(logf logf) {
 	}
 }
 
-// String returns the named environment variable, using os.Getenv.
+// String returns the named environment variable, using os.Getenv,
+// falling back to the config file named by TS_ENVKNOB_FILE if the
+// environment variable isn't set.
 //
 // If the variable is non-empty, it's also tracked & logged as being
 // an in-use knob.
 func String(envVar string) string {
-	v := os.Getenv(envVar)
-	noteEnv(envVar, v)
-	return v
-}
-
-// RegisterString returns a pointer to the value of the named environment
-// variable. If envknob.Setenv is called, the pointed-to-value will be
-// updated.
-func RegisterString(envVar string) *string {
-	mu.Lock()
-	defer mu.Unlock()
-	p, ok := regStr[envVar]
-	if !ok {
-		val := os.Getenv(envVar)
-		if val != "" {
-			noteEnvLocked(envVar, val)
-		}
-		p = &val
-		regStr[envVar] = p
-	}
-	return p
-}
-
-// RegisterBool returns a pointer to the value of the named environment
-// variable. If envknob.Setenv is called, the pointed-to-value will be
-// updated.
-func RegisterBool(envVar string) *bool {
-	mu.Lock()
-	defer mu.Unlock()
-	p, ok := regBool[envVar]
-	if !ok {
-		var b bool
-		p = &b
-		setBoolLocked(p, envVar, os.Getenv(envVar))
-		regBool[envVar] = p
-	}
-	return p
-}
-
-func setBoolLocked(p *bool, envVar, val string) {
-	noteEnvLocked(envVar, val)
-	if val == "" {
-		*p = false
-		return
-	}
-	var err error
-	*p, err = strconv.ParseBool(val)
-	if err != nil {
-		log.Fatalf("invalid boolean environment variable %s value %q", envVar, val)
+	val, source, _ := lookupValue(envVar)
+	if source == envSource {
+		noteEnv(envVar, val)
+	} else {
+		noteEnv(envVar, "")
 	}
+	return val
 }
 
 // Bool returns the boolean value of the named environment variable.
@@ -142,13 +111,15 @@ func BoolDefaultTrue(envVar string) bool {
 
 func boolOr(envVar string, implicitValue bool) bool {
 	assertNotInInit()
-	val := os.Getenv(envVar)
-	if val == "" {
+	val, source, ok := lookupValue(envVar)
+	if !ok || val == "" {
 		return implicitValue
 	}
 	b, err := strconv.ParseBool(val)
 	if err == nil {
-		noteEnv(envVar, strconv.FormatBool(b)) // canonicalize
+		if source == envSource {
+			noteEnv(envVar, strconv.FormatBool(b)) // canonicalize
+		}
 		return b
 	}
 	log.Fatalf("invalid boolean environment variable %s value %q", envVar, val)
@@ -160,8 +131,8 @@ func boolOr(envVar string, implicitValue bool) bool {
 // If the value isn't a valid int, it exits the program with a failure.
 func LookupBool(envVar string) (v bool, ok bool) {
 	assertNotInInit()
-	val := os.Getenv(envVar)
-	if val == "" {
+	val, _, ok := lookupValue(envVar)
+	if !ok || val == "" {
 		return false, false
 	}
 	b, err := strconv.ParseBool(val)
@@ -190,13 +161,15 @@ func OptBool(envVar string) opt.Bool {
 // If the value isn't a valid int, it exits the program with a failure.
 func LookupInt(envVar string) (v int, ok bool) {
 	assertNotInInit()
-	val := os.Getenv(envVar)
-	if val == "" {
+	val, source, ok := lookupValue(envVar)
+	if !ok || val == "" {
 		return 0, false
 	}
 	v, err := strconv.Atoi(val)
 	if err == nil {
-		noteEnv(envVar, val)
+		if source == envSource {
+			noteEnv(envVar, val)
+		}
 		return v, true
 	}
 	log.Fatalf("invalid integer environment variable %s: %v", envVar, val)
@@ -205,30 +178,63 @@ func LookupInt(envVar string) (v int, ok bool) {
 
 // UseWIPCode is whether TAILSCALE_USE_WIP_CODE is set to permit use
 // of Work-In-Progress code.
-func UseWIPCode() bool { return Bool("TAILSCALE_USE_WIP_CODE") }
+func UseWIPCode() bool {
+	assertNotInInit()
+	return Register[bool]("TAILSCALE_USE_WIP_CODE", Spec{
+		Description: "permit use of work-in-progress code",
+		Owner:       "tailscale",
+	}).Load()
+}
 
 // CanSSHD is whether the Tailscale SSH server is allowed to run.
 //
 // If disabled, the SSH server won't start (won't intercept port 22)
 // if already enabled and any attempt to re-enable it will result in
 // an error.
-func CanSSHD() bool { return !Bool("TS_DISABLE_SSH_SERVER") }
+func CanSSHD() bool {
+	assertNotInInit()
+	return !Register[bool]("TS_DISABLE_SSH_SERVER", Spec{
+		Description: "disable the Tailscale SSH server",
+		Owner:       "ssh",
+	}).Load()
+}
 
 // SSHPolicyFile returns the path, if any, to the SSHPolicy JSON file for development.
-func SSHPolicyFile() string { return String("TS_DEBUG_SSH_POLICY_FILE") }
+func SSHPolicyFile() string {
+	return Register[string]("TS_DEBUG_SSH_POLICY_FILE", Spec{
+		Description: "path to the SSHPolicy JSON file, for development",
+		Owner:       "ssh",
+	}).Load()
+}
 
 // SSHIgnoreTailnetPolicy is whether to ignore the Tailnet SSH policy for development.
-func SSHIgnoreTailnetPolicy() bool { return Bool("TS_DEBUG_SSH_IGNORE_TAILNET_POLICY") }
+func SSHIgnoreTailnetPolicy() bool {
+	assertNotInInit()
+	return Register[bool]("TS_DEBUG_SSH_IGNORE_TAILNET_POLICY", Spec{
+		Description: "ignore the tailnet SSH policy, for development",
+		Owner:       "ssh",
+	}).Load()
+}
 
 // NoLogsNoSupport reports whether the client's opted out of log uploads and
 // technical support.
 func NoLogsNoSupport() bool {
-	return Bool("TS_NO_LOGS_NO_SUPPORT")
+	assertNotInInit()
+	return Register[bool]("TS_NO_LOGS_NO_SUPPORT", Spec{
+		Description: "opt out of log uploads and technical support",
+		Owner:       "logtail",
+	}).Load()
 }
 
 // SetNoLogsNoSupport enables no-logs-no-support mode.
 func SetNoLogsNoSupport() {
 	os.Setenv("TS_NO_LOGS_NO_SUPPORT", "true")
+	// If NoLogsNoSupport has already registered the knob, push the new
+	// value through immediately instead of waiting for a config file
+	// reload that will never come for an env-set knob. Ignore the
+	// error: it just means NoLogsNoSupport hasn't been called yet, in
+	// which case it'll pick up the new os.Setenv value on first call.
+	_ = SetValue("TS_NO_LOGS_NO_SUPPORT", "true")
 }
 
 var inMain atomic.Bool
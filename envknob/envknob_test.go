@@ -0,0 +1,220 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package envknob
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// resetForTest clears the package's global registries so tests don't
+// see state left behind by Register/SetValue/Watch calls made by
+// earlier tests or package-level knobs like UseWIPCode.
+func resetForTest(t *testing.T) {
+	t.Helper()
+	regMu.Lock()
+	regs = map[string]*registration{}
+	regMu.Unlock()
+	fileMu.Lock()
+	fileLoaded = false
+	filePath = ""
+	fileValues = map[string]string{}
+	fileMu.Unlock()
+	changeMu.Lock()
+	changeLog = nil
+	changeMu.Unlock()
+}
+
+func TestLookupValuePrecedence(t *testing.T) {
+	resetForTest(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "knobs.json")
+	const contents = `{"TEST_FILE_KNOB":"from-file","TEST_BOTH_KNOB":"from-file"}`
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(fileEnvVar, path)
+	t.Setenv("TEST_BOTH_KNOB", "from-env")
+
+	if v, source, ok := lookupValue("TEST_BOTH_KNOB"); !ok || v != "from-env" || source != envSource {
+		t.Errorf("TEST_BOTH_KNOB = %q, %q, %v; want %q, %q, true", v, source, ok, "from-env", envSource)
+	}
+	if v, source, ok := lookupValue("TEST_FILE_KNOB"); !ok || v != "from-file" || source != fileSource {
+		t.Errorf("TEST_FILE_KNOB = %q, %q, %v; want %q, %q, true", v, source, ok, "from-file", fileSource)
+	}
+	if _, source, ok := lookupValue("TEST_UNSET_KNOB"); ok || source != defaultSource {
+		t.Errorf("TEST_UNSET_KNOB: ok=%v source=%q; want false, %q", ok, source, defaultSource)
+	}
+}
+
+func TestRegisterValidatorSkipsUnsetValue(t *testing.T) {
+	resetForTest(t)
+	var called bool
+	v := Register[int]("TEST_RANGE_KNOB", Spec{
+		Validator: func(val string) error {
+			called = true
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 || n > 10 {
+				return fmt.Errorf("out of range: %q", val)
+			}
+			return nil
+		},
+	})
+	if called {
+		t.Error("Validator was called for an unset knob; it must only see the knob's real values")
+	}
+	if got := v.Load(); got != 0 {
+		t.Errorf("Load() = %d; want 0", got)
+	}
+}
+
+func TestReloadFileUpdatesRegisteredValue(t *testing.T) {
+	resetForTest(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "knobs.json")
+	write := func(val string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(fmt.Sprintf(`{"TEST_RELOAD_KNOB":%q}`, val)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("1s")
+	t.Setenv(fileEnvVar, path)
+
+	d := RegisterDuration("TEST_RELOAD_KNOB")
+	if got, want := d.Load(), time.Second; got != want {
+		t.Fatalf("initial Load() = %v; want %v", got, want)
+	}
+
+	var gotCallback bool
+	OnChange("TEST_RELOAD_KNOB", func() { gotCallback = true })
+
+	write("2s")
+	reloadFile(t.Logf)
+
+	if got, want := d.Load(), 2*time.Second; got != want {
+		t.Errorf("Load() after reload = %v; want %v", got, want)
+	}
+	if !gotCallback {
+		t.Error("OnChange callback wasn't invoked on reload")
+	}
+	changes := Changes()
+	if len(changes) == 0 || changes[len(changes)-1].Source != fileSource {
+		t.Errorf("Changes() = %+v; want last entry with Source %q", changes, fileSource)
+	}
+}
+
+func TestKnobsReportsRuntimeSourceAfterSetValue(t *testing.T) {
+	resetForTest(t)
+	RegisterString("TEST_RUNTIME_KNOB")
+	if err := SetValue("TEST_RUNTIME_KNOB", "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	var found *KnobInfo
+	for _, k := range Knobs() {
+		k := k
+		if k.Name == "TEST_RUNTIME_KNOB" {
+			found = &k
+		}
+	}
+	if found == nil {
+		t.Fatal("TEST_RUNTIME_KNOB not present in Knobs()")
+	}
+	if found.Value != "hello" || found.Source != runtimeSource {
+		t.Errorf("Knobs() entry = %+v; want Value=%q Source=%q", found, "hello", runtimeSource)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	resetForTest(t)
+	RegisterString("TEST_HANDLER_KNOB")
+	h := Handler()
+
+	t.Run("get", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET status = %d; want 200", rec.Code)
+		}
+		var got []KnobInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		var found bool
+		for _, k := range got {
+			if k.Name == "TEST_HANDLER_KNOB" {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("GET response %+v missing TEST_HANDLER_KNOB", got)
+		}
+	})
+
+	t.Run("post disabled by default", func(t *testing.T) {
+		body := strings.NewReader(`{"name":"TEST_HANDLER_KNOB","value":"nope"}`)
+		req := httptest.NewRequest(http.MethodPost, "/", body)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("POST status = %d; want 403 when %s is unset", rec.Code, mutateEnvVar)
+		}
+	})
+
+	t.Run("post with mutation enabled", func(t *testing.T) {
+		t.Setenv(mutateEnvVar, "true")
+		body := strings.NewReader(`{"name":"TEST_HANDLER_KNOB","value":"updated"}`)
+		req := httptest.NewRequest(http.MethodPost, "/", body)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("POST status = %d; want 204, body=%s", rec.Code, rec.Body.String())
+		}
+		if got := RegisterString("TEST_HANDLER_KNOB").Load(); got != "updated" {
+			t.Errorf("knob value after POST = %q; want %q", got, "updated")
+		}
+	})
+}
+
+// TestConcurrentLoadDuringSetValue exercises Value[T].Load racing with
+// SetValue from another goroutine; run with -race.
+func TestConcurrentLoadDuringSetValue(t *testing.T) {
+	resetForTest(t)
+	v := RegisterInt("TEST_RACE_KNOB")
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				v.Load()
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		if err := SetValue("TEST_RACE_KNOB", strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
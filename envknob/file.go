@@ -0,0 +1,530 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package envknob
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	toml "github.com/pelletier/go-toml/v2"
+)
+
+// fileEnvVar is the environment variable naming a JSON or TOML file
+// (selected by its extension) from which knob values are read when
+// the corresponding environment variable isn't set.
+const fileEnvVar = "TS_ENVKNOB_FILE"
+
+// Knob value sources, as returned by lookupValue and reported in
+// KnobInfo.Source.
+const (
+	envSource     = "env"
+	fileSource    = "file"
+	runtimeSource = "runtime"
+	defaultSource = "default"
+)
+
+var (
+	fileMu     sync.Mutex
+	fileLoaded bool
+	filePath   string
+	fileValues = map[string]string{}
+)
+
+// loadFileLocked reads the file named by TS_ENVKNOB_FILE, if any, into
+// fileValues. fileMu must be held. It's idempotent; callers that want
+// to pick up edits should call reloadFile instead.
+func loadFileLocked() {
+	if fileLoaded {
+		return
+	}
+	fileLoaded = true
+	filePath = os.Getenv(fileEnvVar)
+	if filePath == "" {
+		return
+	}
+	vals, err := parseKnobFile(filePath)
+	if err != nil {
+		log.Fatalf("envknob: reading %s=%q: %v", fileEnvVar, filePath, err)
+	}
+	fileValues = vals
+}
+
+func parseKnobFile(path string) (map[string]string, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]any{}
+	switch ext := filepath.Ext(path); ext {
+	case ".json":
+		if err := json.Unmarshal(buf, &raw); err != nil {
+			return nil, fmt.Errorf("parsing JSON: %w", err)
+		}
+	case ".toml":
+		if err := toml.Unmarshal(buf, &raw); err != nil {
+			return nil, fmt.Errorf("parsing TOML: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported envknob config file extension %q (want .json or .toml)", ext)
+	}
+	vals := make(map[string]string, len(raw))
+	for k, v := range raw {
+		switch v := v.(type) {
+		case string:
+			vals[k] = v
+		case bool:
+			vals[k] = strconv.FormatBool(v)
+		default:
+			vals[k] = fmt.Sprint(v)
+		}
+	}
+	return vals, nil
+}
+
+// lookupValue returns the effective value of envVar and the source it
+// came from ("env", "file", or "default"), applying the env > file >
+// default precedence described in the package doc. ok is false if
+// envVar isn't set anywhere.
+func lookupValue(envVar string) (val, source string, ok bool) {
+	if v, isSet := os.LookupEnv(envVar); isSet {
+		return v, envSource, true
+	}
+	fileMu.Lock()
+	loadFileLocked()
+	v, isSet := fileValues[envVar]
+	fileMu.Unlock()
+	if isSet {
+		return v, fileSource, true
+	}
+	return "", defaultSource, false
+}
+
+// reloadFile re-reads the config file named by TS_ENVKNOB_FILE and
+// updates every registered knob not overridden by its environment
+// variable, logging and recording (see Changes) each value that
+// changed. It's called by Watch whenever the file changes.
+func reloadFile(logf logf) {
+	vals, err := parseKnobFile(filePath)
+	if err != nil {
+		logf("envknob: reloading %s: %v", filePath, err)
+		return
+	}
+	fileMu.Lock()
+	fileValues = vals
+	fileMu.Unlock()
+
+	// Apply the changes with regMu held, but collect the registrations
+	// that actually changed and invoke their callbacks only after
+	// releasing regMu: an OnChange callback that calls back into the
+	// package (Knobs, Register, OnChange, SetValue all take regMu)
+	// would otherwise deadlock this goroutine against itself.
+	var changed []*registration
+	regMu.Lock()
+	for envVar, r := range regs {
+		if _, isSet := os.LookupEnv(envVar); isSet {
+			continue // the environment variable always wins
+		}
+		old := r.getRaw()
+		val, source, _ := lookupValue(envVar)
+		if val == old {
+			continue
+		}
+		if err := r.setChecked(val); err != nil {
+			logf("envknob: ignoring invalid reloaded value for %s: %v", envVar, err)
+			continue
+		}
+		r.setSource(source)
+		recordChange(envVar, old, val, source)
+		logf("envknob: %s changed from %q to %q (source=%s)", envVar, old, val, source)
+		changed = append(changed, r)
+	}
+	regMu.Unlock()
+
+	for _, r := range changed {
+		r.invokeCallbacks()
+	}
+}
+
+// pollInterval is how often pollFile checks the config file's mtime
+// when an fsnotify watcher can't be created (e.g. unsupported platform
+// or no inotify instances left). A watcher that is created but can't
+// watch the file's directory makes Watch return an error instead.
+const pollInterval = 5 * time.Second
+
+func pollFile(ctx context.Context, path string, logf logf) {
+	var lastMod time.Time
+	if fi, err := os.Stat(path); err == nil {
+		lastMod = fi.ModTime()
+	}
+	t := time.NewTicker(pollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			fi, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if mt := fi.ModTime(); mt.After(lastMod) {
+				lastMod = mt
+				reloadFile(logf)
+			}
+		}
+	}
+}
+
+// Watch starts watching the file named by TS_ENVKNOB_FILE, if it's
+// set, for changes, keeping every knob registered via RegisterString,
+// RegisterBool, RegisterInt, RegisterDuration, or Register up to date
+// as the file is edited, without requiring a process restart. It uses
+// fsnotify where available, falling back to polling the file's mtime
+// every 5 seconds if an fsnotify watcher can't be created.
+//
+// Watch returns immediately after starting its background goroutine
+// (or doing nothing, if TS_ENVKNOB_FILE isn't set); ctx controls the
+// goroutine's lifetime. It returns an error if the file's directory
+// can't be watched. logf receives a line for each reload that fails
+// and each value that changes.
+func Watch(ctx context.Context, logf logf) error {
+	fileMu.Lock()
+	loadFileLocked()
+	path := filePath
+	fileMu.Unlock()
+	if path == "" {
+		return nil
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		logf("envknob: fsnotify unavailable (%v); polling %s every %v instead", err, path, pollInterval)
+		go pollFile(ctx, path, logf)
+		return nil
+	}
+	// Watch the containing directory, not the file itself: editors and
+	// config management tools commonly replace the file via rename,
+	// which doesn't preserve a watch on the old inode.
+	dir := filepath.Dir(path)
+	if err := w.Add(dir); err != nil {
+		w.Close()
+		return fmt.Errorf("envknob: watching %s: %w", dir, err)
+	}
+	go func() {
+		defer w.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) == filepath.Clean(path) {
+					reloadFile(logf)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				logf("envknob: watch error: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// registerable is the set of types usable with Register.
+type registerable interface {
+	string | bool | int | time.Duration
+}
+
+// Value is a live-updated knob value returned by Register. Load is
+// safe to call concurrently with reloads triggered by Watch or
+// SetValue from another goroutine: the value is stored behind an
+// atomic.Pointer, so holders of a *Value[T] (the tsnet/derp-style
+// long-lived subsystems Register exists for) never observe a partial
+// or torn write.
+type Value[T registerable] struct {
+	p atomic.Pointer[T]
+}
+
+// Load returns the knob's current value.
+func (v *Value[T]) Load() T {
+	p := v.p.Load()
+	if p == nil {
+		var zero T
+		return zero
+	}
+	return *p
+}
+
+func (v *Value[T]) store(val T) {
+	v.p.Store(&val)
+}
+
+// parseKnobValue parses val, the knob's raw string value, as a T. An
+// empty val (the knob is unset) parses as T's zero value.
+func parseKnobValue[T registerable](val string) (T, error) {
+	var zero T
+	switch any(zero).(type) {
+	case string:
+		return any(val).(T), nil
+	case bool:
+		if val == "" {
+			return zero, nil
+		}
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return zero, err
+		}
+		return any(b).(T), nil
+	case int:
+		if val == "" {
+			return zero, nil
+		}
+		i, err := strconv.Atoi(val)
+		if err != nil {
+			return zero, err
+		}
+		return any(i).(T), nil
+	case time.Duration:
+		if val == "" {
+			return zero, nil
+		}
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return zero, err
+		}
+		return any(d).(T), nil
+	default:
+		panic("unreachable")
+	}
+}
+
+// registration is the non-generic bookkeeping kept for every knob
+// registered via Register, so code that doesn't know T (Watch, the
+// change log, the introspection endpoint) can still update and
+// describe it.
+type registration struct {
+	envVar string
+	v      any  // *Value[T], for the T Register was instantiated with
+	kind   Kind // T's Kind, for introspection
+
+	// Metadata from Spec, for introspection via Knobs/Handler.
+	desc  string
+	owner string
+
+	// validate, if non-nil, is Spec.Validator: it's run against a
+	// knob's raw string value, from any source, before it's parsed and
+	// stored.
+	validate func(val string) error
+
+	// setRaw parses val and stores it into v. It does not run validate;
+	// callers that haven't already checked val against validate should
+	// use setChecked instead.
+	setRaw func(val string) error
+	// getRaw renders the current value of v back to a string, for
+	// change detection and auditing.
+	getRaw func() string
+
+	mu     sync.Mutex // guards cbs and source
+	cbs    []func()
+	source string // last source the value was set from: see the *Source constants
+}
+
+// setChecked validates val (if a validator was given to Register) and,
+// if it passes, parses and stores it. val == "" means the knob is
+// unset (env and file both missed it, i.e. it's at its default), so
+// the validator isn't run: a range/format check written against a
+// knob's real values would otherwise reject the default on every
+// process that simply doesn't set it.
+func (r *registration) setChecked(val string) error {
+	if val != "" && r.validate != nil {
+		if err := r.validate(val); err != nil {
+			return err
+		}
+	}
+	return r.setRaw(val)
+}
+
+func (r *registration) setSource(source string) {
+	r.mu.Lock()
+	r.source = source
+	r.mu.Unlock()
+}
+
+func (r *registration) getSource() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.source
+}
+
+func (r *registration) invokeCallbacks() {
+	r.mu.Lock()
+	cbs := append([]func(){}, r.cbs...)
+	r.mu.Unlock()
+	for _, cb := range cbs {
+		cb()
+	}
+}
+
+var (
+	regMu sync.Mutex
+	regs  = map[string]*registration{}
+)
+
+func newRegistration[T registerable](envVar string, v *Value[T]) *registration {
+	return &registration{
+		envVar: envVar,
+		v:      v,
+		setRaw: func(val string) error {
+			parsed, err := parseKnobValue[T](val)
+			if err != nil {
+				return err
+			}
+			v.store(parsed)
+			return nil
+		},
+		getRaw: func() string {
+			return fmt.Sprint(v.Load())
+		},
+	}
+}
+
+// Register returns a live value of the named knob, sourced with the
+// env > file > default precedence documented on the package. Unlike a
+// one-off call to String or Bool, the value behind the returned
+// *Value[T] keeps up with config file edits observed by Watch, and
+// with runtime mutations via SetValue, so long-lived subsystems like
+// tsnet or derp can hold onto it and observe live-tunable settings
+// (timeouts, buffer sizes, feature toggles) without a restart. Load is
+// safe to call from any goroutine, including while a reload is in
+// progress on another one.
+//
+// spec supplies the metadata (description, owner, validator) shown by
+// Knobs and Handler; pass the zero Spec if none of that applies.
+//
+// T must be string, bool, int, or time.Duration. Repeated calls with
+// the same envVar and the same T return the same *Value[T]; spec is
+// ignored on calls after the first.
+func Register[T registerable](envVar string, spec Spec) *Value[T] {
+	regMu.Lock()
+	defer regMu.Unlock()
+	if r, ok := regs[envVar]; ok {
+		return r.v.(*Value[T])
+	}
+	v := new(Value[T])
+	r := newRegistration(envVar, v)
+	r.kind = kindOf[T]()
+	r.desc = spec.Description
+	r.owner = spec.Owner
+	r.validate = spec.Validator
+	val, source, _ := lookupValue(envVar)
+	if val != "" && r.validate != nil {
+		if err := r.validate(val); err != nil {
+			// Unlike a reload or SetValue, there's no prior good value to
+			// fall back to here: this is the first one. Fall back to the
+			// knob's zero value rather than taking the whole binary down
+			// over one bad line in a config file or env var.
+			log.Printf("envknob: %s (from %s) rejected by validator: %v; falling back to default", envVar, source, err)
+			val, source = "", defaultSource
+		}
+	}
+	if err := r.setRaw(val); err != nil {
+		log.Fatalf("envknob: invalid value for %s (from %s): %v", envVar, source, err)
+	}
+	r.setSource(source)
+	regs[envVar] = r
+	if source == envSource {
+		noteEnv(envVar, val)
+	}
+	return v
+}
+
+// RegisterString is Register for string-valued knobs.
+func RegisterString(envVar string) *Value[string] { return Register[string](envVar, Spec{}) }
+
+// RegisterBool is Register for boolean-valued knobs. As with Bool, an
+// invalid value fatally exits the process.
+func RegisterBool(envVar string) *Value[bool] { return Register[bool](envVar, Spec{}) }
+
+// RegisterInt is Register for integer-valued knobs.
+func RegisterInt(envVar string) *Value[int] { return Register[int](envVar, Spec{}) }
+
+// RegisterDuration is Register for knobs holding a time.Duration,
+// parsed with time.ParseDuration (e.g. "250ms", "2s").
+func RegisterDuration(envVar string) *Value[time.Duration] {
+	return Register[time.Duration](envVar, Spec{})
+}
+
+// OnChange registers fn to be called, from the goroutine started by
+// Watch (or from SetValue), whenever the value of the knob registered
+// for envVar changes after the initial Register call. It panics if
+// envVar hasn't already been registered via RegisterString,
+// RegisterBool, RegisterInt, RegisterDuration, or Register.
+func OnChange(envVar string, fn func()) {
+	regMu.Lock()
+	r, ok := regs[envVar]
+	regMu.Unlock()
+	if !ok {
+		panic(fmt.Sprintf("envknob: OnChange(%q): not registered", envVar))
+	}
+	r.mu.Lock()
+	r.cbs = append(r.cbs, fn)
+	r.mu.Unlock()
+}
+
+// ChangeEvent records a single change to a registered knob's value,
+// kept in memory so operators can audit runtime tuning. See Changes.
+type ChangeEvent struct {
+	Time   time.Time
+	Name   string
+	Old    string
+	New    string
+	Source string // "file" or "default" (config file reload), or "runtime" (SetValue)
+}
+
+// maxChangeLog bounds the in-memory audit log so a knob that's
+// reloaded frequently can't grow it without bound.
+const maxChangeLog = 200
+
+var (
+	changeMu  sync.Mutex
+	changeLog []ChangeEvent
+)
+
+func recordChange(name, old, newVal, source string) {
+	changeMu.Lock()
+	defer changeMu.Unlock()
+	changeLog = append(changeLog, ChangeEvent{
+		Time:   time.Now(),
+		Name:   name,
+		Old:    old,
+		New:    newVal,
+		Source: source,
+	})
+	if len(changeLog) > maxChangeLog {
+		changeLog = changeLog[len(changeLog)-maxChangeLog:]
+	}
+}
+
+// Changes returns a snapshot of recent knob value changes, oldest
+// first, for operator auditing. It's empty until Watch observes a
+// config file change or a value is changed via SetValue.
+func Changes() []ChangeEvent {
+	changeMu.Lock()
+	defer changeMu.Unlock()
+	return append([]ChangeEvent(nil), changeLog...)
+}
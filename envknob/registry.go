@@ -0,0 +1,171 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package envknob
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Kind is the type of a knob registered via Register, as reported by
+// Knobs and Handler.
+type Kind string
+
+// The kinds of knobs Register supports.
+const (
+	KindString   Kind = "string"
+	KindBool     Kind = "bool"
+	KindInt      Kind = "int"
+	KindDuration Kind = "duration"
+)
+
+func kindOf[T registerable]() Kind {
+	var zero T
+	switch any(zero).(type) {
+	case string:
+		return KindString
+	case bool:
+		return KindBool
+	case int:
+		return KindInt
+	default:
+		return KindDuration
+	}
+}
+
+// Spec supplies optional metadata for a knob registered via Register,
+// surfaced through Knobs and the introspection endpoint returned by
+// Handler.
+type Spec struct {
+	// Description is a short, human-readable summary of what the knob
+	// does and when to use it.
+	Description string
+	// Owner identifies the subsystem responsible for the knob, e.g.
+	// "derp" or "magicsock".
+	Owner string
+	// Validator, if non-nil, is run against a knob's raw string value,
+	// whether it comes from the environment, the config file, this
+	// initial registration, or a runtime mutation via Handler. A
+	// non-nil error rejects the value, leaving the knob unchanged —
+	// except at initial registration, where there's no prior good
+	// value to keep: a rejected initial value logs a warning and falls
+	// back to the knob's default instead of taking down the binary.
+	// Validator is never called with val == "", which means the knob
+	// is unset and thus at its default: write Validator to check only
+	// the values the knob can actually take, not its zero value.
+	Validator func(val string) error
+}
+
+// KnobInfo is the introspection view of a single registered knob,
+// returned by Knobs and served as JSON by Handler's GET endpoint.
+type KnobInfo struct {
+	Name        string `json:"name"`
+	Type        Kind   `json:"type"`
+	Value       string `json:"value"`
+	Source      string `json:"source"` // "env", "file", "runtime", or "default"
+	Description string `json:"description,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+}
+
+// Knobs returns the current state of every knob registered via
+// RegisterString, RegisterBool, RegisterInt, RegisterDuration, or
+// Register, sorted by name. Source reflects where each knob's current
+// value actually came from, including "runtime" for a value most
+// recently changed via SetValue — not just env/file/default, which
+// wouldn't account for runtime mutation.
+func Knobs() []KnobInfo {
+	regMu.Lock()
+	defer regMu.Unlock()
+	out := make([]KnobInfo, 0, len(regs))
+	for _, r := range regs {
+		out = append(out, KnobInfo{
+			Name:        r.envVar,
+			Type:        r.kind,
+			Value:       r.getRaw(),
+			Source:      r.getSource(),
+			Description: r.desc,
+			Owner:       r.owner,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// SetValue updates the live value of a knob previously registered via
+// RegisterString, RegisterBool, RegisterInt, RegisterDuration, or
+// Register, without a restart or a file change. The new value takes
+// precedence over the knob's current source, including an environment
+// variable, and is reported with Source "runtime" until a later config
+// file reload changes it. It's used by Handler's POST endpoint,
+// and can be called directly by tests. It returns an error if envVar
+// isn't a registered knob, or if its Spec.Validator rejects val.
+func SetValue(envVar, val string) error {
+	regMu.Lock()
+	r, ok := regs[envVar]
+	regMu.Unlock()
+	if !ok {
+		return fmt.Errorf("envknob: %s is not a registered knob", envVar)
+	}
+	old := r.getRaw()
+	if err := r.setChecked(val); err != nil {
+		return fmt.Errorf("envknob: invalid value for %s: %w", envVar, err)
+	}
+	r.setSource(runtimeSource)
+	recordChange(envVar, old, val, runtimeSource)
+	r.invokeCallbacks()
+	return nil
+}
+
+// mutateEnvVar, if set, additionally allows POST requests to Handler
+// to mutate knob values at runtime. It's a deliberately explicit,
+// auditable opt-in rather than something any debug mux exposes by
+// default.
+const mutateEnvVar = "TS_DEBUG_ALLOW_KNOB_MUTATION"
+
+// Handler returns an http.Handler that serves JSON introspection of
+// every knob registered via Register (and its String/Bool/Int/Duration
+// wrappers): name, type, current value, source, description, and
+// owner. It's meant to be mounted on tailscaled's existing debug mux
+// so support engineers have a single surface instead of grepping the
+// codebase for env var names.
+//
+// GET returns the JSON array described by KnobInfo.
+//
+// POST is only honored if TS_DEBUG_ALLOW_KNOB_MUTATION is set; it
+// otherwise replies 403. When allowed, POSTing a JSON body of
+// {"name": "...", "value": "..."} calls SetValue to update that
+// knob's live value, replying 204 on success or 400 if the knob is
+// unknown or the value is rejected by its validator.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(Knobs())
+		case http.MethodPost:
+			if !Bool(mutateEnvVar) {
+				http.Error(w, "runtime knob mutation is disabled; set "+mutateEnvVar+" to enable it", http.StatusForbidden)
+				return
+			}
+			var req struct {
+				Name  string `json:"name"`
+				Value string `json:"value"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := SetValue(req.Name, req.Value); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}